@@ -0,0 +1,166 @@
+// Package journal gives cmdAdd a crash-safe record of which steps toward
+// attaching a container to the network it has started and which of those
+// it finished. cmdAdd runs store.Add, a policy-agent poll, and per-network
+// rule engine setup in sequence; a process killed partway through used to
+// leave a container with half-applied iptables state and no way to clean
+// it up, and a retried ADD for the same ContainerID would double-insert
+// rules on top of it. A Journal lets cmdAdd notice that trail on the next
+// ADD for the same ContainerID and roll it back before starting over, and
+// lets cmdDel tear down that state even if the datastore entry it would
+// normally read is gone.
+package journal
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Journal is a write-ahead log of named steps for one container's ADD.
+// Each step is appended as "start" before it runs and again as "done"
+// once it finishes; a step recorded as started but never finished means
+// the previous ADD for this container was interrupted there.
+type Journal struct {
+	path    string
+	done    map[string]bool
+	pending []string // steps seen started-but-not-done, in start order
+	all     []string // every step ever seen started, in start order
+}
+
+// Open loads (or creates) the journal for containerID. It's stored next
+// to datastorePath using the same suffix convention as the datastore's
+// own lock and version files.
+func Open(datastorePath, containerID string) (*Journal, error) {
+	j := &Journal{
+		path: fmt.Sprintf("%s_journal_%s", datastorePath, containerID),
+		done: map[string]bool{},
+	}
+
+	f, err := os.Open(j.path)
+	if os.IsNotExist(err) {
+		return j, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("opening journal: %s", err)
+	}
+	defer f.Close()
+
+	seen := map[string]bool{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		status, step := parts[0], parts[1]
+		switch status {
+		case "start":
+			if !seen[step] {
+				seen[step] = true
+				j.all = append(j.all, step)
+			}
+		case "done":
+			j.done[step] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading journal: %s", err)
+	}
+
+	for _, step := range j.all {
+		if !j.done[step] {
+			j.pending = append(j.pending, step)
+		}
+	}
+	return j, nil
+}
+
+// Record appends step to the journal as started. It must be called
+// before the work step names is about to do.
+func (j *Journal) Record(step string) error {
+	if err := j.append("start:" + step); err != nil {
+		return err
+	}
+	j.all = append(j.all, step)
+	return nil
+}
+
+// Complete appends step to the journal as done. It must only be called
+// after the work step names has fully succeeded.
+func (j *Journal) Complete(step string) error {
+	j.done[step] = true
+	return j.append("done:" + step)
+}
+
+// Pending returns every step that was started in a previous Open but
+// never completed, in the order they were started.
+func (j *Journal) Pending() []string {
+	return j.pending
+}
+
+// Steps returns every step ever started against this journal, done or
+// not, in start order. cmdDel uses this to find rule state to tear down
+// when the datastore has no record of the container at all.
+func (j *Journal) Steps() []string {
+	return j.all
+}
+
+// Remove deletes the journal file. Call it once a container's ADD has
+// fully succeeded, or once cmdDel has finished tearing everything down.
+func (j *Journal) Remove() error {
+	if err := os.Remove(j.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (j *Journal) append(line string) error {
+	f, err := os.OpenFile(j.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("writing journal: %s", err)
+	}
+	defer f.Close()
+
+	if _, err := fmt.Fprintln(f, line); err != nil {
+		return fmt.Errorf("writing journal: %s", err)
+	}
+	return f.Sync()
+}
+
+// RuleStep builds the deterministic journal step name for the rule
+// engine setup of one (ifName, containerIP) pair, so cmdAdd and cmdDel
+// agree on the same name for the same address.
+func RuleStep(ifName, containerIP string) string {
+	return "rule:" + ifName + ":" + containerIP
+}
+
+// DelegateStep builds the deterministic journal step name for adding the
+// delegate network named ifName.
+func DelegateStep(ifName string) string {
+	return "delegate:" + ifName
+}
+
+// ParseRuleStep splits a step produced by RuleStep back into its ifName
+// and containerIP, or ok=false if step isn't a rule step.
+func ParseRuleStep(step string) (ifName, containerIP string, ok bool) {
+	if !strings.HasPrefix(step, "rule:") {
+		return "", "", false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(step, "rule:"), ":", 2)
+	if len(parts) != 2 {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// ParseDelegateStep returns the ifName encoded in a step produced by
+// DelegateStep, or ok=false if step isn't a delegate step.
+func ParseDelegateStep(step string) (ifName string, ok bool) {
+	if !strings.HasPrefix(step, "delegate:") {
+		return "", false
+	}
+	return strings.TrimPrefix(step, "delegate:"), true
+}
+
+const StoreStep = "store"
@@ -0,0 +1,114 @@
+package journal_test
+
+import (
+	"os"
+	"path/filepath"
+
+	"cni-wrapper-plugin/journal"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Journal", func() {
+	var datastorePath string
+
+	BeforeEach(func() {
+		tmpDir, err := os.MkdirTemp("", "journal-test")
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(func() { os.RemoveAll(tmpDir) })
+		datastorePath = filepath.Join(tmpDir, "store")
+	})
+
+	Describe("Open", func() {
+		It("returns an empty journal when none exists yet", func() {
+			j, err := journal.Open(datastorePath, "container-1")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(j.Pending()).To(BeEmpty())
+			Expect(j.Steps()).To(BeEmpty())
+		})
+	})
+
+	Describe("Record and Complete", func() {
+		It("tracks a recorded step in Steps without reporting it as pending in the same session", func() {
+			j, err := journal.Open(datastorePath, "container-1")
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(j.Record("delegate:eth0")).To(Succeed())
+			Expect(j.Pending()).To(BeEmpty())
+			Expect(j.Steps()).To(ConsistOf("delegate:eth0"))
+
+			Expect(j.Complete("delegate:eth0")).To(Succeed())
+			Expect(j.Pending()).To(BeEmpty())
+			Expect(j.Steps()).To(ConsistOf("delegate:eth0"))
+		})
+	})
+
+	Describe("re-opening after a crash", func() {
+		It("reports steps started but never completed as pending", func() {
+			j, err := journal.Open(datastorePath, "container-1")
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(j.Record("delegate:eth0")).To(Succeed())
+			Expect(j.Record("rule:eth0:10.255.1.5")).To(Succeed())
+			Expect(j.Complete("delegate:eth0")).To(Succeed())
+
+			reopened, err := journal.Open(datastorePath, "container-1")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reopened.Pending()).To(ConsistOf("rule:eth0:10.255.1.5"))
+			Expect(reopened.Steps()).To(ConsistOf("delegate:eth0", "rule:eth0:10.255.1.5"))
+		})
+	})
+
+	Describe("Remove", func() {
+		It("deletes the journal file and tolerates it already being gone", func() {
+			j, err := journal.Open(datastorePath, "container-1")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(j.Record("delegate:eth0")).To(Succeed())
+
+			Expect(j.Remove()).To(Succeed())
+			Expect(j.Remove()).To(Succeed())
+
+			reopened, err := journal.Open(datastorePath, "container-1")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reopened.Steps()).To(BeEmpty())
+		})
+	})
+
+	Describe("RuleStep/ParseRuleStep", func() {
+		It("round-trips the ifName and containerIP", func() {
+			step := journal.RuleStep("eth0", "10.255.1.5")
+			ifName, containerIP, ok := journal.ParseRuleStep(step)
+			Expect(ok).To(BeTrue())
+			Expect(ifName).To(Equal("eth0"))
+			Expect(containerIP).To(Equal("10.255.1.5"))
+		})
+
+		It("rejects a step that isn't a rule step", func() {
+			_, _, ok := journal.ParseRuleStep(journal.DelegateStep("eth0"))
+			Expect(ok).To(BeFalse())
+		})
+
+		It("round-trips a v6 containerIP", func() {
+			step := journal.RuleStep("eth0", "fd00::5")
+			ifName, containerIP, ok := journal.ParseRuleStep(step)
+			Expect(ok).To(BeTrue())
+			Expect(ifName).To(Equal("eth0"))
+			Expect(containerIP).To(Equal("fd00::5"))
+		})
+	})
+
+	Describe("DelegateStep/ParseDelegateStep", func() {
+		It("round-trips the ifName", func() {
+			step := journal.DelegateStep("eth0")
+			ifName, ok := journal.ParseDelegateStep(step)
+			Expect(ok).To(BeTrue())
+			Expect(ifName).To(Equal("eth0"))
+		})
+
+		It("rejects a step that isn't a delegate step", func() {
+			_, ok := journal.ParseDelegateStep(journal.RuleStep("eth0", "10.255.1.5"))
+			Expect(ok).To(BeFalse())
+		})
+	})
+})
@@ -0,0 +1,147 @@
+package legacynet
+
+import (
+	"cni-wrapper-plugin/lib"
+	"fmt"
+	"os"
+	"sync"
+
+	"lib/rules"
+)
+
+// IPTablesHandle is the go-iptables handle NetOut/NetIn/AddIPMasq issue
+// their rules through; it's an alias for *rules.LockedIPTables.
+type IPTablesHandle = *rules.LockedIPTables
+
+// IPTablesRuleEngine is the original RuleEngine backend: it drives NetOut,
+// NetIn and PluginController.AddIPMasq/DelIPMasq through go-iptables,
+// exactly as cmdAdd/cmdDel did before RuleEngine existed.
+type IPTablesRuleEngine struct {
+	ipTables IPTablesHandle
+	masq     MasqController
+	cfg      RuleEngineConfig
+
+	mu      sync.Mutex
+	netOuts map[string]*NetOut
+	netIns  map[string]*NetIn
+}
+
+// NewIPTablesRuleEngine builds a RuleEngine backed by go-iptables.
+func NewIPTablesRuleEngine(ipt IPTablesHandle, masq MasqController, cfg RuleEngineConfig) *IPTablesRuleEngine {
+	return &IPTablesRuleEngine{
+		ipTables: ipt,
+		masq:     masq,
+		cfg:      cfg,
+		netOuts:  map[string]*NetOut{},
+		netIns:   map[string]*NetIn{},
+	}
+}
+
+func (e *IPTablesRuleEngine) Initialize(containerHandle, containerIP string) error {
+	netOut := &NetOut{
+		ChainNamer:            &ChainNamer{MaxLength: 28},
+		IPTables:              e.ipTables,
+		Converter:             &NetOutRuleConverter{Logger: os.Stderr},
+		ASGLogging:            e.cfg.ASGLogging,
+		C2CLogging:            e.cfg.C2CLogging,
+		DeniedLogsPerSec:      e.cfg.DeniedLogsPerSec,
+		AcceptedUDPLogsPerSec: e.cfg.AcceptedUDPLogsPerSec,
+		IngressTag:            e.cfg.IngressTag,
+		VTEPName:              e.cfg.VTEPName,
+		HostInterfaceNames:    e.cfg.HostInterfaceNames,
+		ContainerHandle:       containerHandle,
+		ContainerIP:           containerIP,
+		HostTCPServices:       e.cfg.HostTCPServices,
+		DNSServers:            e.cfg.DNSServers,
+	}
+	if err := netOut.Initialize(); err != nil {
+		return fmt.Errorf("initialize net out: %s", err)
+	}
+
+	netIn := &NetIn{
+		ChainNamer:         &ChainNamer{MaxLength: 28},
+		IPTables:           e.ipTables,
+		IngressTag:         e.cfg.IngressTag,
+		HostInterfaceNames: e.cfg.HostInterfaceNames,
+	}
+	if err := netIn.Initialize(containerHandle); err != nil {
+		return fmt.Errorf("initialize net in: %s", err)
+	}
+
+	e.mu.Lock()
+	e.netOuts[containerHandle] = netOut
+	e.netIns[containerHandle] = netIn
+	e.mu.Unlock()
+
+	return nil
+}
+
+func (e *IPTablesRuleEngine) InsertRules(containerHandle, containerIP, instanceAddress string, netOutRules []lib.NetOutRule, portMappings []lib.PortMapping) error {
+	e.mu.Lock()
+	netOut, netIn := e.netOuts[containerHandle], e.netIns[containerHandle]
+	e.mu.Unlock()
+	if netOut == nil || netIn == nil {
+		return fmt.Errorf("insert rules: %s was never initialized", containerHandle)
+	}
+
+	for _, mapping := range portMappings {
+		if mapping.HostPort <= 0 {
+			return fmt.Errorf("cannot allocate port %d", mapping.HostPort)
+		}
+		if err := netIn.AddRule(containerHandle, int(mapping.HostPort), int(mapping.ContainerPort), instanceAddress, containerIP); err != nil {
+			return fmt.Errorf("adding netin rule: %s", err)
+		}
+	}
+
+	if err := netOut.BulkInsertRules(netOutRules); err != nil {
+		return fmt.Errorf("bulk insert: %s", err) // not tested
+	}
+
+	return nil
+}
+
+func (e *IPTablesRuleEngine) Cleanup(containerHandle, containerIP string) error {
+	e.mu.Lock()
+	netOut, netIn := e.netOuts[containerHandle], e.netIns[containerHandle]
+	delete(e.netOuts, containerHandle)
+	delete(e.netIns, containerHandle)
+	e.mu.Unlock()
+
+	if netIn == nil {
+		netIn = &NetIn{
+			ChainNamer:         &ChainNamer{MaxLength: 28},
+			IPTables:           e.ipTables,
+			IngressTag:         e.cfg.IngressTag,
+			HostInterfaceNames: e.cfg.HostInterfaceNames,
+		}
+	}
+	if netOut == nil {
+		netOut = &NetOut{
+			ChainNamer:         &ChainNamer{MaxLength: 28},
+			IPTables:           e.ipTables,
+			Converter:          &NetOutRuleConverter{Logger: os.Stderr},
+			ContainerHandle:    containerHandle,
+			ContainerIP:        containerIP,
+			HostInterfaceNames: e.cfg.HostInterfaceNames,
+		}
+	}
+
+	var errs []error
+	if err := netIn.Cleanup(containerHandle); err != nil {
+		errs = append(errs, fmt.Errorf("net in cleanup: %s", err))
+	}
+	if err := netOut.Cleanup(); err != nil {
+		errs = append(errs, fmt.Errorf("net out cleanup: %s", err))
+	}
+	if err := e.masq.DelIPMasq(containerIP, e.cfg.NoMasqueradeCIDRRange, e.cfg.VTEPName); err != nil {
+		errs = append(errs, fmt.Errorf("removing ip masq: %s", err))
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%v", errs)
+	}
+	return nil
+}
+
+func (e *IPTablesRuleEngine) Masquerade(containerIP, noMasqueradeCIDRRange, vtepName string) error {
+	return e.masq.AddIPMasq(containerIP, noMasqueradeCIDRRange, vtepName)
+}
@@ -0,0 +1,403 @@
+package legacynet
+
+import (
+	"cni-wrapper-plugin/lib"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+// NFTablesRuleEngine is the nftables-backed RuleEngine. Where the iptables
+// backend issues one `iptables -I`/`iptables-restore` call per rule or
+// batch, this backend builds up a single nftables transaction per call and
+// commits it atomically, so a container's firewall state never exists
+// half-applied.
+//
+// ASG/NetOut egress enforcement is not translated yet (see asgRuleExprs):
+// this backend is only a like-for-like replacement for containers with no
+// NetOutRules configured, not a general substitute for "iptables" on real
+// Cloud Foundry workloads, which rely on ASGs. Select it with that in mind.
+//
+// All state lives in one `inet silk` table with three base chains:
+//   - netin:  per-container DNAT for port mappings, jumped to from the
+//     prerouting hook
+//   - netout: per-container ASG rules, jumped to from the forward hook
+//   - masq:   per-container SNAT/MASQUERADE rules, jumped to from the
+//     postrouting hook
+//
+// Each container gets its own regular (non-base) chain under netin/netout/
+// masq, named after its containerHandle and reached by a jump rule in the
+// base chain, so Cleanup can remove those jumps and delete exactly those
+// chains instead of hunting for individual rules.
+type NFTablesRuleEngine struct {
+	cfg RuleEngineConfig
+
+	mu      sync.Mutex
+	conn    *nftables.Conn
+	table   *nftables.Table
+	netin   *nftables.Chain
+	netout  *nftables.Chain
+	masq    *nftables.Chain
+	perConn map[string]*containerChains
+	// handleByIP lets Masquerade, which only ever gets a containerIP (see
+	// the RuleEngine interface), find the containerHandle Initialize
+	// registered that address under, so it can install into that
+	// container's own masq chain instead of the shared base one.
+	handleByIP map[string]string
+}
+
+type containerChains struct {
+	netin  *nftables.Chain
+	netout *nftables.Chain
+	masq   *nftables.Chain
+}
+
+// NewNFTablesRuleEngine opens a netlink connection and ensures the `inet
+// silk` table and its base chains exist.
+func NewNFTablesRuleEngine(cfg RuleEngineConfig) (*NFTablesRuleEngine, error) {
+	conn, err := nftables.New()
+	if err != nil {
+		return nil, fmt.Errorf("connecting to nftables: %s", err)
+	}
+
+	e := &NFTablesRuleEngine{
+		cfg:        cfg,
+		conn:       conn,
+		perConn:    map[string]*containerChains{},
+		handleByIP: map[string]string{},
+	}
+
+	e.table = conn.AddTable(&nftables.Table{Name: "silk", Family: nftables.TableFamilyINet})
+
+	e.netin = conn.AddChain(&nftables.Chain{
+		Name:     "netin",
+		Table:    e.table,
+		Type:     nftables.ChainTypeNAT,
+		Hooknum:  nftables.ChainHookPrerouting,
+		Priority: nftables.ChainPriorityNATDest,
+	})
+	e.netout = conn.AddChain(&nftables.Chain{
+		Name:     "netout",
+		Table:    e.table,
+		Type:     nftables.ChainTypeFilter,
+		Hooknum:  nftables.ChainHookForward,
+		Priority: nftables.ChainPriorityFilter,
+	})
+	e.masq = conn.AddChain(&nftables.Chain{
+		Name:     "masq",
+		Table:    e.table,
+		Type:     nftables.ChainTypeNAT,
+		Hooknum:  nftables.ChainHookPostrouting,
+		Priority: nftables.ChainPriorityNATSource,
+	})
+
+	if err := conn.Flush(); err != nil {
+		return nil, fmt.Errorf("creating silk nftables table: %s", err)
+	}
+
+	return e, nil
+}
+
+func chainName(prefix, containerHandle string) string {
+	return fmt.Sprintf("%s-%s", prefix, containerHandle)
+}
+
+func (e *NFTablesRuleEngine) Initialize(containerHandle, containerIP string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	netin := e.conn.AddChain(&nftables.Chain{Name: chainName("netin", containerHandle), Table: e.table})
+	netout := e.conn.AddChain(&nftables.Chain{Name: chainName("netout", containerHandle), Table: e.table})
+	masq := e.conn.AddChain(&nftables.Chain{Name: chainName("masq", containerHandle), Table: e.table})
+
+	ip := net.ParseIP(containerIP)
+	e.conn.AddRule(&nftables.Rule{
+		Table: e.table,
+		Chain: e.netin,
+		Exprs: jumpOnDestIP(ip, netin.Name),
+	})
+	e.conn.AddRule(&nftables.Rule{
+		Table: e.table,
+		Chain: e.netout,
+		Exprs: jumpOnSourceIP(ip, netout.Name),
+	})
+	e.conn.AddRule(&nftables.Rule{
+		Table: e.table,
+		Chain: e.masq,
+		Exprs: jumpOnSourceIP(ip, masq.Name),
+	})
+
+	if err := e.conn.Flush(); err != nil {
+		return fmt.Errorf("initializing nftables chains for %s: %s", containerHandle, err)
+	}
+
+	e.perConn[containerHandle] = &containerChains{netin: netin, netout: netout, masq: masq}
+	e.handleByIP[containerIP] = containerHandle
+	return nil
+}
+
+func (e *NFTablesRuleEngine) InsertRules(containerHandle, containerIP, instanceAddress string, netOutRules []lib.NetOutRule, portMappings []lib.PortMapping) error {
+	e.mu.Lock()
+	chains := e.perConn[containerHandle]
+	e.mu.Unlock()
+	if chains == nil {
+		return fmt.Errorf("insert rules: %s was never initialized", containerHandle)
+	}
+
+	for _, mapping := range portMappings {
+		if mapping.HostPort <= 0 {
+			return fmt.Errorf("cannot allocate port %d", mapping.HostPort)
+		}
+		e.conn.AddRule(&nftables.Rule{
+			Table: e.table,
+			Chain: chains.netin,
+			Exprs: dnatPortMapping(instanceAddress, uint16(mapping.HostPort), containerIP, uint16(mapping.ContainerPort)),
+		})
+	}
+
+	for _, asg := range netOutRules {
+		ruleExprs, err := asgRuleExprs(asg)
+		if err != nil {
+			return fmt.Errorf("insert rules: %s", err)
+		}
+		for _, r := range ruleExprs {
+			e.conn.AddRule(&nftables.Rule{Table: e.table, Chain: chains.netout, Exprs: r})
+		}
+	}
+
+	if err := e.conn.Flush(); err != nil {
+		return fmt.Errorf("committing nftables rules for %s: %s", containerHandle, err)
+	}
+	return nil
+}
+
+func (e *NFTablesRuleEngine) Cleanup(containerHandle, containerIP string) error {
+	e.mu.Lock()
+	chains := e.perConn[containerHandle]
+	delete(e.perConn, containerHandle)
+	delete(e.handleByIP, containerIP)
+	e.mu.Unlock()
+
+	if chains == nil {
+		// Nothing was ever initialized (e.g. a retried DEL); still try the
+		// chains by name in case a previous process crashed mid-ADD.
+		chains = &containerChains{
+			netin:  &nftables.Chain{Name: chainName("netin", containerHandle), Table: e.table},
+			netout: &nftables.Chain{Name: chainName("netout", containerHandle), Table: e.table},
+			masq:   &nftables.Chain{Name: chainName("masq", containerHandle), Table: e.table},
+		}
+	}
+
+	// Initialize's jump rules in the base chains still reference these
+	// chains; they go first, or the chains cannot be deleted.
+	owned := map[string]bool{chains.netin.Name: true, chains.netout.Name: true, chains.masq.Name: true}
+	for _, base := range []*nftables.Chain{e.netin, e.netout, e.masq} {
+		baseRules, err := e.conn.GetRules(e.table, base)
+		if err != nil {
+			return fmt.Errorf("listing nftables rules for %s: %s", containerHandle, err)
+		}
+		for _, r := range baseRules {
+			for _, ex := range r.Exprs {
+				if v, ok := ex.(*expr.Verdict); ok && v.Kind == expr.VerdictJump && owned[v.Chain] {
+					_ = e.conn.DelRule(r)
+				}
+			}
+		}
+	}
+
+	e.conn.DelChain(chains.netin)
+	e.conn.DelChain(chains.netout)
+	e.conn.DelChain(chains.masq)
+
+	if err := e.conn.Flush(); err != nil {
+		return fmt.Errorf("removing nftables chains for %s: %s", containerHandle, err)
+	}
+	return nil
+}
+
+// Masquerade installs into the per-container masq chain Initialize set up
+// for containerIP, found via handleByIP, rather than the shared base masq
+// chain: a rule added straight to the base chain would have no handle or
+// container-owned chain for Cleanup to find and remove later. Falls back
+// to the base chain only if Initialize was never called for this address
+// (which Cleanup will then also be unable to target, same as a netin/netout
+// rule installed without Initialize).
+func (e *NFTablesRuleEngine) Masquerade(containerIP, noMasqueradeCIDRRange, vtepName string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	chain := e.masq
+	if handle, ok := e.handleByIP[containerIP]; ok {
+		if chains := e.perConn[handle]; chains != nil && chains.masq != nil {
+			chain = chains.masq
+		}
+	}
+
+	ip := net.ParseIP(containerIP)
+	e.conn.AddRule(&nftables.Rule{
+		Table: e.table,
+		Chain: chain,
+		Exprs: masqueradeExprs(ip, noMasqueradeCIDRRange, vtepName),
+	})
+
+	if err := e.conn.Flush(); err != nil {
+		return fmt.Errorf("installing masquerade rule for %s: %s", containerIP, err)
+	}
+	return nil
+}
+
+// The expr.* builders below cover the match-and-jump/DNAT/masquerade
+// shapes NetIn/NetOut need, not the full nftables expression language. Each
+// one is family-aware: cmdAdd's dual-stack loop (see cmdAdd in main.go)
+// calls Initialize/Masquerade once per address a container has, v4
+// and v6 alike, so a v6-only builder here would silently stop matching any
+// traffic for v6 containers.
+
+// ipHeaderOffset returns the network-header offset, length and raw bytes
+// to match ip at, for either IPv4 or IPv6. ok is false if ip is neither
+// (e.g. a parse failure upstream left it nil).
+func ipHeaderOffset(ip net.IP) (offset, length uint32, data []byte, ok bool) {
+	if v4 := ip.To4(); v4 != nil {
+		return 12, 4, v4, true
+	}
+	if v6 := ip.To16(); v6 != nil {
+		return 8, 16, v6, true
+	}
+	return 0, 0, nil, false
+}
+
+// ipHeaderDestOffset is ipHeaderOffset's destination-address counterpart;
+// the source and destination fields sit at different offsets in both
+// header formats.
+func ipHeaderDestOffset(ip net.IP) (offset, length uint32, data []byte, ok bool) {
+	if v4 := ip.To4(); v4 != nil {
+		return 16, 4, v4, true
+	}
+	if v6 := ip.To16(); v6 != nil {
+		return 24, 16, v6, true
+	}
+	return 0, 0, nil, false
+}
+
+// ifname right-pads name to IFNAMSIZ (16) bytes, the fixed-width,
+// nul-padded form expr.Meta{Key: expr.MetaKeyOIFNAME} compares an
+// interface's name against.
+func ifname(name string) []byte {
+	b := make([]byte, 16)
+	copy(b, name)
+	return b
+}
+
+func natFamily(ip net.IP) uint32 {
+	if ip.To4() != nil {
+		return unix.NFPROTO_IPV4
+	}
+	return unix.NFPROTO_IPV6
+}
+
+func jumpOnDestIP(ip net.IP, target string) []expr.Any {
+	offset, length, data, ok := ipHeaderDestOffset(ip)
+	if !ok {
+		return nil
+	}
+	return []expr.Any{
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: offset, Len: length},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: data},
+		&expr.Verdict{Kind: expr.VerdictJump, Chain: target},
+	}
+}
+
+func jumpOnSourceIP(ip net.IP, target string) []expr.Any {
+	offset, length, data, ok := ipHeaderOffset(ip)
+	if !ok {
+		return nil
+	}
+	return []expr.Any{
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: offset, Len: length},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: data},
+		&expr.Verdict{Kind: expr.VerdictJump, Chain: target},
+	}
+}
+
+// dnatPortMapping matches TCP traffic destined to hostPort on
+// instanceAddress (when set) and redirects it to containerIP:containerPort.
+// Without the destination-port match, this rule would DNAT every TCP
+// packet the host forwards, not just the one mapped port.
+func dnatPortMapping(instanceAddress string, hostPort uint16, containerIP string, containerPort uint16) []expr.Any {
+	exprs := []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.IPPROTO_TCP}},
+	}
+
+	if instanceIP := net.ParseIP(instanceAddress); instanceIP != nil {
+		if offset, length, data, ok := ipHeaderDestOffset(instanceIP); ok {
+			exprs = append(exprs,
+				&expr.Payload{DestRegister: 2, Base: expr.PayloadBaseNetworkHeader, Offset: offset, Len: length},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 2, Data: data},
+			)
+		}
+	}
+
+	exprs = append(exprs,
+		&expr.Payload{DestRegister: 3, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 3, Data: []byte{byte(hostPort >> 8), byte(hostPort)}},
+	)
+
+	ip := net.ParseIP(containerIP)
+	_, _, addrData, _ := ipHeaderOffset(ip)
+	exprs = append(exprs,
+		&expr.Immediate{Register: 1, Data: addrData},
+		&expr.Immediate{Register: 2, Data: []byte{byte(containerPort >> 8), byte(containerPort)}},
+		&expr.NAT{Type: expr.NATTypeDestNAT, Family: natFamily(ip), RegAddrMin: 1, RegProtoMin: 2},
+	)
+	return exprs
+}
+
+// asgRuleExprs would translate a single NetOutRule (protocol, port range,
+// destination CIDR) into one or more nftables rule expression lists, but
+// that translation hasn't landed yet: it needs lib.NetOutRule's concrete
+// fields, which live in cni-wrapper-plugin/lib and aren't available to
+// write against here. Guessing at that shape would risk shipping a translation that
+// silently doesn't match the real type, which is worse than this. Rather
+// than install nothing and leave a container's egress unfiltered,
+// InsertRules fails the ADD whenever a container actually has NetOutRules
+// to enforce; containers with no ASG rules configured are unaffected. This
+// makes the nftables RuleEngine a like-for-like replacement for NetIn/
+// masquerade only, not yet for ASG-enforcing (i.e. most real CF) workloads
+// -- see the package doc above before selecting it.
+func asgRuleExprs(rule lib.NetOutRule) ([][]expr.Any, error) {
+	return nil, fmt.Errorf("nftables rule engine does not yet support ASG/NetOut rule translation; use RuleEngine \"iptables\" for containers with NetOutRules")
+}
+
+func masqueradeExprs(ip net.IP, noMasqueradeCIDRRange, vtepName string) []expr.Any {
+	offset, length, data, ok := ipHeaderOffset(ip)
+	if !ok {
+		return nil
+	}
+	exprs := []expr.Any{
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: offset, Len: length},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: data},
+	}
+	if vtepName != "" {
+		exprs = append(exprs,
+			&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 3},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 3, Data: ifname(vtepName)},
+		)
+	}
+	if noMasqueradeCIDRRange != "" {
+		if _, cidr, err := net.ParseCIDR(noMasqueradeCIDRRange); err == nil && len(cidr.Mask) == len(data) {
+			destOffset, destLength, _, _ := ipHeaderDestOffset(ip)
+			exprs = append(exprs,
+				&expr.Payload{DestRegister: 2, Base: expr.PayloadBaseNetworkHeader, Offset: destOffset, Len: destLength},
+				&expr.Bitwise{SourceRegister: 2, DestRegister: 2, Len: destLength, Mask: cidr.Mask, Xor: make([]byte, len(cidr.Mask))},
+				&expr.Cmp{Op: expr.CmpOpNeq, Register: 2, Data: cidr.IP.To16()[len(cidr.IP.To16())-len(cidr.Mask):]},
+			)
+		}
+	}
+	exprs = append(exprs, &expr.Masq{})
+	return exprs
+}
@@ -0,0 +1,107 @@
+package legacynet
+
+import (
+	"net"
+
+	"cni-wrapper-plugin/lib"
+
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("dnatPortMapping", func() {
+	It("matches only the configured host port, not every TCP packet", func() {
+		exprs := dnatPortMapping("10.255.0.1", 8080, "10.255.1.5", 7000)
+
+		var sawPortMatch bool
+		for _, e := range exprs {
+			if cmp, ok := e.(*expr.Cmp); ok && cmp.Data != nil && len(cmp.Data) == 2 {
+				Expect(cmp.Data).To(Equal([]byte{byte(8080 >> 8), byte(8080)}))
+				sawPortMatch = true
+			}
+		}
+		Expect(sawPortMatch).To(BeTrue(), "expected a destination-port match expression")
+	})
+
+	It("builds a v4 NAT target for a v4 container address", func() {
+		exprs := dnatPortMapping("10.255.0.1", 8080, "10.255.1.5", 7000)
+
+		last, ok := exprs[len(exprs)-1].(*expr.NAT)
+		Expect(ok).To(BeTrue())
+		Expect(last.Family).To(Equal(uint32(unix.NFPROTO_IPV4)))
+	})
+
+	It("builds a v6-correct NAT target for a v6 container address", func() {
+		exprs := dnatPortMapping("", 8080, "fd00::5", 7000)
+
+		last, ok := exprs[len(exprs)-1].(*expr.NAT)
+		Expect(ok).To(BeTrue())
+		Expect(last.Family).To(Equal(uint32(unix.NFPROTO_IPV6)))
+	})
+})
+
+var _ = Describe("asgRuleExprs", func() {
+	It("fails loudly instead of silently dropping ASG enforcement", func() {
+		_, err := asgRuleExprs(lib.NetOutRule{})
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+var _ = Describe("jumpOnDestIP/jumpOnSourceIP", func() {
+	It("matches v4 destination addresses at the v4 offset", func() {
+		exprs := jumpOnDestIP(net.ParseIP("10.255.1.5"), "netin-abc")
+		payload := exprs[0].(*expr.Payload)
+		Expect(payload.Offset).To(Equal(uint32(16)))
+		Expect(payload.Len).To(Equal(uint32(4)))
+	})
+
+	It("matches v6 destination addresses at the v6 offset", func() {
+		exprs := jumpOnDestIP(net.ParseIP("fd00::5"), "netin-abc")
+		payload := exprs[0].(*expr.Payload)
+		Expect(payload.Offset).To(Equal(uint32(24)))
+		Expect(payload.Len).To(Equal(uint32(16)))
+	})
+
+	It("matches v6 source addresses at the v6 offset", func() {
+		exprs := jumpOnSourceIP(net.ParseIP("fd00::5"), "netout-abc")
+		payload := exprs[0].(*expr.Payload)
+		Expect(payload.Offset).To(Equal(uint32(8)))
+		Expect(payload.Len).To(Equal(uint32(16)))
+	})
+})
+
+var _ = Describe("masqueradeExprs", func() {
+	It("builds a v6 match for a v6 container address", func() {
+		exprs := masqueradeExprs(net.ParseIP("fd00::5"), "", "silk-vtep")
+		payload := exprs[0].(*expr.Payload)
+		Expect(payload.Offset).To(Equal(uint32(8)))
+		Expect(payload.Len).To(Equal(uint32(16)))
+	})
+
+	It("only masquerades traffic leaving on vtepName", func() {
+		exprs := masqueradeExprs(net.ParseIP("10.255.1.5"), "", "silk-vtep")
+
+		var sawOIFMatch bool
+		for i, e := range exprs {
+			if meta, ok := e.(*expr.Meta); ok && meta.Key == expr.MetaKeyOIFNAME {
+				cmp, ok := exprs[i+1].(*expr.Cmp)
+				Expect(ok).To(BeTrue(), "expected a Cmp expression right after the OIFNAME meta match")
+				Expect(cmp.Data).To(Equal(ifname("silk-vtep")))
+				sawOIFMatch = true
+			}
+		}
+		Expect(sawOIFMatch).To(BeTrue(), "expected an egress-interface match on vtepName")
+	})
+
+	It("skips the no-masquerade CIDR check on a family mismatch instead of building a malformed rule", func() {
+		exprs := masqueradeExprs(net.ParseIP("fd00::5"), "10.255.0.0/16", "silk-vtep")
+
+		for _, e := range exprs {
+			_, ok := e.(*expr.Bitwise)
+			Expect(ok).To(BeFalse(), "expected no bitwise CIDR match for mismatched address families")
+		}
+	})
+})
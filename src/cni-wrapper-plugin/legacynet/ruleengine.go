@@ -0,0 +1,72 @@
+package legacynet
+
+import (
+	"cni-wrapper-plugin/lib"
+	"fmt"
+)
+
+// RuleEngine installs and tears down the per-container firewall state a
+// single network attachment needs: NetIn port mappings, NetOut ASG rules,
+// and the default outbound masquerade rule. NetOut/NetIn/AddIPMasq started
+// out as direct go-iptables callers; RuleEngine lets a second backend
+// (nftables) stand in without cmdAdd/cmdDel knowing which one is active.
+type RuleEngine interface {
+	// Initialize creates the chains for containerHandle/containerIP and
+	// wires them into the host's netfilter hooks, which differ per
+	// backend (e.g. prerouting/forward/postrouting for nftables). It must be
+	// safe to call at most once per (containerHandle, containerIP) pair.
+	Initialize(containerHandle, containerIP string) error
+
+	// InsertRules installs netOutRules and portMappings for
+	// containerHandle/containerIP. Initialize must have already run.
+	InsertRules(containerHandle, containerIP, instanceAddress string, netOutRules []lib.NetOutRule, portMappings []lib.PortMapping) error
+
+	// Cleanup removes every chain, rule and masquerade entry that
+	// Initialize/InsertRules/Masquerade installed for
+	// containerHandle/containerIP. It must tolerate being called for a
+	// container that was never fully initialized.
+	Cleanup(containerHandle, containerIP string) error
+
+	// Masquerade installs the default SNAT/MASQUERADE rule that lets
+	// containerIP reach the outside world through vtepName, except for
+	// traffic destined to noMasqueradeCIDR.
+	Masquerade(containerIP, noMasqueradeCIDR, vtepName string) error
+}
+
+// RuleEngineConfig carries the host-level settings every RuleEngine
+// implementation needs, regardless of backend.
+type RuleEngineConfig struct {
+	IngressTag            string
+	VTEPName              string
+	NoMasqueradeCIDRRange string
+	HostInterfaceNames    []string
+	ASGLogging            bool
+	C2CLogging            bool
+	DeniedLogsPerSec      string
+	AcceptedUDPLogsPerSec string
+	HostTCPServices       []string
+	DNSServers            []string
+}
+
+// MasqController is the subset of *lib.PluginController's masquerade API a
+// RuleEngine needs; it's how both backends reach the existing
+// AddIPMasq/DelIPMasq implementation instead of re-deriving it.
+type MasqController interface {
+	AddIPMasq(containerIP, noMasqueradeCIDRRange, vtepName string) error
+	DelIPMasq(containerIP, noMasqueradeCIDRRange, vtepName string) error
+}
+
+// NewRuleEngine builds the RuleEngine selected by kind ("iptables" or
+// "nftables"). iptables is the long-standing go-iptables backend; nftables
+// is the newer atomic-transaction backend. An empty kind defaults to
+// "iptables" so existing deployments don't need a config change to upgrade.
+func NewRuleEngine(kind string, ipt IPTablesHandle, masq MasqController, cfg RuleEngineConfig) (RuleEngine, error) {
+	switch kind {
+	case "", "iptables":
+		return NewIPTablesRuleEngine(ipt, masq, cfg), nil
+	case "nftables":
+		return NewNFTablesRuleEngine(cfg)
+	default:
+		return nil, fmt.Errorf("unknown rule engine %q: must be \"iptables\" or \"nftables\"", kind)
+	}
+}
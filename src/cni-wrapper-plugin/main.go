@@ -1,10 +1,20 @@
 package main
 
+// cni-wrapper-plugin/lib, lib/datastore, lib/serial, adapter and
+// interfacelookup below are first-party sibling packages this plugin has
+// always depended on; they are not part of this checkout, so the types and
+// functions cmdAdd/cmdDel use from them (lib.NetworkDelegate,
+// lib.WrapperConfig/LoadWrapperConfig, datastore.Store.Add's multi-address
+// signature, lib.PluginController's IP6Tables field, and so on) can't be
+// changed from here. This file is written against the versions of those
+// packages the rest of this series already assumes.
 import (
 	"cni-wrapper-plugin/adapter"
 	"cni-wrapper-plugin/interfacelookup"
+	"cni-wrapper-plugin/journal"
 	"cni-wrapper-plugin/legacynet"
 	"cni-wrapper-plugin/lib"
+	"cni-wrapper-plugin/metrics"
 	"encoding/json"
 	"fmt"
 	"lib/datastore"
@@ -13,41 +23,102 @@ import (
 	"net"
 	"os"
 	"sync"
+	"time"
 
 	"io/ioutil"
 	"net/http"
 
 	"code.cloudfoundry.org/filelock"
 	"github.com/containernetworking/cni/pkg/skel"
-	"github.com/containernetworking/cni/pkg/types/current"
+	types100 "github.com/containernetworking/cni/pkg/types/100"
 	"github.com/containernetworking/cni/pkg/version"
 	"github.com/coreos/go-iptables/iptables"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
+// containerAddress pairs a single container IP with the IPTables handle
+// (v4 or v6) that should be used to install rules for it.
+type containerAddress struct {
+	ip       net.IP
+	iptables *rules.LockedIPTables
+}
+
+func (a containerAddress) String() string {
+	return a.ip.String()
+}
+
+// network is a single attached delegate network after its ADD has
+// succeeded: the interface name it was brought up on, the (possibly
+// dual-stack) addresses the delegate handed back for it, and the raw
+// delegate config, kept around so a later failure can roll this network
+// back.
+type network struct {
+	ifName   string
+	delegate lib.NetworkDelegate
+	result   *types100.Result
+	addrs    []containerAddress
+}
+
 func cmdAdd(args *skel.CmdArgs) error {
 	cfg, err := lib.LoadWrapperConfig(args.StdinData)
 	if err != nil {
 		return err
 	}
 
+	rec := metrics.NewRecorder("add")
+	defer rec.Done(cfg.MetricsSocket, cfg.MetricsTextfileDir)
+
 	pluginController, err := newPluginController(cfg.IPTablesLockFile)
 	if err != nil {
 		return err
 	}
 
-	result, err := pluginController.DelegateAdd(cfg.Delegate)
-	if err != nil {
-		return fmt.Errorf("delegate call: %s", err)
+	// cfg.Delegates carries one entry per attached network. For the common
+	// single-network case it has exactly one entry built from the legacy
+	// cfg.Delegate field, so callers who don't know about multi-network
+	// attachments see no change in behavior.
+	//
+	// lib.NetworkDelegate and cfg.Delegates/LoadWrapperConfig themselves
+	// live in cni-wrapper-plugin/lib, which (like container.Networks over
+	// in cmdDel below) isn't part of this checkout; this file is written
+	// against the shape those already assume.
+	delegates := cfg.Delegates
+	if len(delegates) == 0 {
+		delegates = []lib.NetworkDelegate{{IfName: args.IfName, Delegate: cfg.Delegate}}
 	}
 
-	result030, err := current.NewResultFromResult(result)
+	localDNSServers, err := getLocalDNSServers(cfg.DNSServers)
 	if err != nil {
-		return fmt.Errorf("converting result from delegate plugin: %s", err) // not tested
+		return err
+	}
+
+	interfaceNameLookup := interfacelookup.InterfaceNameLookup{
+		NetlinkAdapter: &adapter.NetlinkAdapter{},
+	}
+
+	var interfaceNames []string
+	if len(cfg.TemporaryUnderlayInterfaceNames) > 0 {
+		interfaceNames = cfg.TemporaryUnderlayInterfaceNames
+	} else {
+		interfaceNames, err = interfaceNameLookup.GetNamesFromIPs(cfg.UnderlayIPs)
+		if err != nil {
+			return fmt.Errorf("looking up interface names: %s", err) // not tested
+		}
 	}
 
-	containerIP := result030.IPs[0].Address.IP
+	ruleEngineCfg := legacynet.RuleEngineConfig{
+		IngressTag:            cfg.IngressTag,
+		VTEPName:              cfg.VTEPName,
+		NoMasqueradeCIDRRange: cfg.NoMasqueradeCIDRRange,
+		HostInterfaceNames:    interfaceNames,
+		ASGLogging:            cfg.IPTablesASGLogging,
+		C2CLogging:            cfg.IPTablesC2CLogging,
+		DeniedLogsPerSec:      cfg.IPTablesDeniedLogsPerSec,
+		AcceptedUDPLogsPerSec: cfg.IPTablesAcceptedUDPLogsPerSec,
+		HostTCPServices:       cfg.HostTCPServices,
+		DNSServers:            localDNSServers,
+	}
 
-	// Add container metadata info
 	store := &datastore.Store{
 		Serializer: &serial.Serial{},
 		Locker: &filelock.Locker{
@@ -62,6 +133,56 @@ func cmdAdd(args *skel.CmdArgs) error {
 		CacheMutex:      new(sync.RWMutex),
 	}
 
+	// A journal left behind by a previous process for this ContainerID means
+	// this ContainerID has network state on the host already, whether that
+	// previous ADD crashed partway through or ran to completion and is only
+	// being retried (e.g. the runtime re-ADDs after a response timeout).
+	// Neither Initialize nor addNetworks/DelegateAdd are safe to call twice
+	// for the same (containerHandle, containerIP)/network, so every
+	// recorded step -- done or still pending -- gets rolled back before
+	// this ADD starts, not just the steps an earlier attempt never
+	// finished. That leaves a truly clean slate to build on, instead of
+	// re-running completed steps on top of state they already installed.
+	jrnl, err := journal.Open(cfg.Datastore, args.ContainerID)
+	if err != nil {
+		return fmt.Errorf("opening journal: %s", err)
+	}
+	if steps := jrnl.Steps(); len(steps) > 0 {
+		fmt.Fprintf(os.Stderr, "found an existing add for %s, rolling back before retrying: %v\n", args.ContainerID, steps)
+		rollbackJournal(pluginController, store, ruleEngineCfg, cfg.RuleEngine, args.ContainerID, delegates, steps)
+		if err := jrnl.Remove(); err != nil {
+			return fmt.Errorf("removing journal after rollback: %s", err)
+		}
+		jrnl, err = journal.Open(cfg.Datastore, args.ContainerID)
+		if err != nil {
+			return fmt.Errorf("opening journal: %s", err)
+		}
+	}
+
+	var networks []network
+	if rollbackErr := addNetworks(pluginController, delegates, rec, jrnl, &networks); rollbackErr != nil {
+		rollbackNetworks(pluginController, networks)
+		return rollbackErr
+	}
+
+	var containerAddrs []containerAddress
+	for _, netw := range networks {
+		containerAddrs = append(containerAddrs, netw.addrs...)
+	}
+
+	// networksByIfName is what actually gets persisted, keyed the same way
+	// cmdDel reads container.Networks back: per attached network, every
+	// address (v4, v6, or both) the delegate handed back for it. Flattening
+	// this to a single []string would lose exactly the association cmdDel
+	// needs to find a non-first network's rule state once the journal's
+	// been removed on a normal, non-crashed teardown.
+	networksByIfName := make(map[string][]string, len(networks))
+	for _, netw := range networks {
+		for _, addr := range netw.addrs {
+			networksByIfName[netw.ifName] = append(networksByIfName[netw.ifName], addr.String())
+		}
+	}
+
 	var cniAddData struct {
 		Metadata map[string]interface{}
 	}
@@ -69,17 +190,32 @@ func cmdAdd(args *skel.CmdArgs) error {
 		return err // not tested, this should be impossible
 	}
 
-	if err := store.Add(args.ContainerID, containerIP.String(), cniAddData.Metadata); err != nil {
-		storeErr := fmt.Errorf("store add: %s", err)
+	if err := jrnl.Record(journal.StoreStep); err != nil {
+		return fmt.Errorf("journal: %s", err)
+	}
+	storeStart := time.Now()
+	addErr := store.Add(args.ContainerID, networksByIfName, cniAddData.Metadata)
+	rec.Observe("store", time.Since(storeStart))
+	if addErr != nil {
+		storeErr := fmt.Errorf("store add: %s", addErr)
 		fmt.Fprintf(os.Stderr, "%s", storeErr)
 		fmt.Fprint(os.Stderr, "cleaning up from error")
-		err = pluginController.DelIPMasq(containerIP.String(), cfg.NoMasqueradeCIDRRange, cfg.VTEPName)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "during cleanup: removing IP masq: %s", err)
+		for _, addr := range containerAddrs {
+			if err := pluginController.DelIPMasq(addr.String(), cfg.NoMasqueradeCIDRRange, cfg.VTEPName); err != nil {
+				fmt.Fprintf(os.Stderr, "during cleanup: removing IP masq: %s", err)
+			}
 		}
+		// The delegate calls that built networks already succeeded and are
+		// marked "done" in the journal; since we're undoing them here,
+		// ourselves, roll them back too, or they leak every time store.Add
+		// fails.
+		rollbackNetworks(pluginController, networks)
 
 		return storeErr
 	}
+	if err := jrnl.Complete(journal.StoreStep); err != nil {
+		return fmt.Errorf("journal: %s", err)
+	}
 
 	resp, err := http.DefaultClient.Get(fmt.Sprintf("http://%s/force-policy-poll-cycle", cfg.PolicyAgentForcePollAddress))
 	if err != nil {
@@ -91,83 +227,221 @@ func cmdAdd(args *skel.CmdArgs) error {
 		return fmt.Errorf("vpa response code: %v with message: %s", resp.StatusCode, body)
 	}
 
-	localDNSServers, err := getLocalDNSServers(cfg.DNSServers)
-	if err != nil {
-		return err
+	if args.ContainerID == "" {
+		return fmt.Errorf("invalid Container ID")
 	}
 
-	interfaceNameLookup := interfacelookup.InterfaceNameLookup{
-		NetlinkAdapter: &adapter.NetlinkAdapter{},
-	}
+	portMappings := cfg.RuntimeConfig.PortMappings
+	netOutRules := cfg.RuntimeConfig.NetOutRules
 
-	var interfaceNames []string
-	if len(cfg.TemporaryUnderlayInterfaceNames) > 0 {
-		interfaceNames = cfg.TemporaryUnderlayInterfaceNames
-	} else {
-		interfaceNames, err = interfaceNameLookup.GetNamesFromIPs(cfg.UnderlayIPs)
-		if err != nil {
-			return fmt.Errorf("looking up interface names: %s", err) // not tested
+	// Every (network, family) pair gets its own chains, rules and
+	// masquerade setup, driven through whichever RuleEngine cfg.RuleEngine
+	// selects and named after the containerID/ifname pair that owns it.
+	// Each pair's setup is bracketed by a journal step so a process killed
+	// partway through leaves a trail the next ADD can roll back instead of
+	// half-applied rules nothing ever cleans up.
+	for _, netw := range networks {
+		containerHandle := args.ContainerID + "/" + netw.ifName
+
+		for _, addr := range netw.addrs {
+			step := journal.RuleStep(netw.ifName, addr.String())
+			if err := jrnl.Record(step); err != nil {
+				return fmt.Errorf("journal: %s", err)
+			}
+
+			ruleEngine, err := legacynet.NewRuleEngine(cfg.RuleEngine, addr.iptables, pluginController, ruleEngineCfg)
+			if err != nil {
+				return fmt.Errorf("selecting rule engine: %s", err)
+			}
+
+			initStart := time.Now()
+			initErr := ruleEngine.Initialize(containerHandle, addr.String())
+			rec.Observe("netout-init", time.Since(initStart))
+			if initErr != nil {
+				return fmt.Errorf("initialize rule engine: %s", initErr)
+			}
+
+			insertStart := time.Now()
+			insertErr := ruleEngine.InsertRules(containerHandle, addr.String(), cfg.InstanceAddress, netOutRules, portMappings)
+			rec.Observe("bulk-insert-rules", time.Since(insertStart))
+			if insertErr != nil {
+				return fmt.Errorf("insert rules: %s", insertErr)
+			}
+
+			masqStart := time.Now()
+			masqErr := ruleEngine.Masquerade(addr.String(), cfg.NoMasqueradeCIDRRange, cfg.VTEPName)
+			rec.Observe("masquerade", time.Since(masqStart))
+			if masqErr != nil {
+				return fmt.Errorf("error setting up default ip masq rule: %s", masqErr)
+			}
+
+			if err := jrnl.Complete(step); err != nil {
+				return fmt.Errorf("journal: %s", err)
+			}
 		}
 	}
 
-	if args.ContainerID == "" {
-		return fmt.Errorf("invalid Container ID")
+	if err := jrnl.Remove(); err != nil {
+		fmt.Fprintf(os.Stderr, "removing journal: %s\n", err)
 	}
 
-	netOutProvider := legacynet.NetOut{
-		ChainNamer: &legacynet.ChainNamer{
-			MaxLength: 28,
-		},
-		IPTables:              pluginController.IPTables,
-		Converter:             &legacynet.NetOutRuleConverter{Logger: os.Stderr},
-		ASGLogging:            cfg.IPTablesASGLogging,
-		C2CLogging:            cfg.IPTablesC2CLogging,
-		DeniedLogsPerSec:      cfg.IPTablesDeniedLogsPerSec,
-		AcceptedUDPLogsPerSec: cfg.IPTablesAcceptedUDPLogsPerSec,
-		IngressTag:            cfg.IngressTag,
-		VTEPName:              cfg.VTEPName,
-		HostInterfaceNames:    interfaceNames,
-		ContainerHandle:       args.ContainerID,
-		ContainerIP:           containerIP.String(),
-		HostTCPServices:       cfg.HostTCPServices,
-		DNSServers:            localDNSServers,
-	}
-	if err := netOutProvider.Initialize(); err != nil {
-		return fmt.Errorf("initialize net out: %s", err)
-	}
+	mergedResult := mergeNetworkResults(networks)
+	mergedResult.DNS.Nameservers = cfg.DNSServers
+	return mergedResult.Print()
+}
 
-	netinProvider := legacynet.NetIn{
-		ChainNamer: &legacynet.ChainNamer{
-			MaxLength: 28,
-		},
-		IPTables:           pluginController.IPTables,
-		IngressTag:         cfg.IngressTag,
-		HostInterfaceNames: interfaceNames,
-	}
-	err = netinProvider.Initialize(args.ContainerID)
+// addNetworks calls DelegateAdd once per requested network, appending each
+// successfully-added one to *networks as it goes (so the caller can roll
+// back everything added so far if a later network fails). Each delegate
+// call is bracketed by a journal step so a crash between delegates leaves
+// a record of which ones need tearing down on the next ADD.
+func addNetworks(pluginController *lib.PluginController, delegates []lib.NetworkDelegate, rec *metrics.Recorder, jrnl *journal.Journal, networks *[]network) error {
+	for _, d := range delegates {
+		step := journal.DelegateStep(d.IfName)
+		if err := jrnl.Record(step); err != nil {
+			return fmt.Errorf("journal: %s", err)
+		}
 
-	portMappings := cfg.RuntimeConfig.PortMappings
-	for _, netIn := range portMappings {
-		if netIn.HostPort <= 0 {
-			return fmt.Errorf("cannot allocate port %d", netIn.HostPort)
+		delegateStart := time.Now()
+		result, err := pluginController.DelegateAdd(d.Delegate)
+		rec.Observe("delegate", time.Since(delegateStart))
+		if err != nil {
+			return fmt.Errorf("delegate call for network %q: %s", d.IfName, err)
 		}
-		if err := netinProvider.AddRule(args.ContainerID, int(netIn.HostPort), int(netIn.ContainerPort), cfg.InstanceAddress, containerIP.String()); err != nil {
-			return fmt.Errorf("adding netin rule: %s", err)
+
+		result100, err := types100.NewResultFromResult(result)
+		if err != nil {
+			return fmt.Errorf("converting result from delegate plugin for network %q: %s", d.IfName, err) // not tested
+		}
+		if len(result100.IPs) == 0 {
+			return fmt.Errorf("delegate result for network %q contained no container addresses", d.IfName)
+		}
+
+		// The delegate may hand back a v4 address, a v6 address, or both
+		// (dual stack). Track every address it gave us, alongside the
+		// IPTables handle (v4 or v6) that rules for that address need to
+		// go through.
+		var addrs []containerAddress
+		for _, ipc := range result100.IPs {
+			addr := containerAddress{ip: ipc.Address.IP, iptables: pluginController.IPTables}
+			if addr.ip.To4() == nil {
+				addr.iptables = pluginController.IP6Tables
+			}
+			addrs = append(addrs, addr)
+		}
+
+		*networks = append(*networks, network{
+			ifName:   d.IfName,
+			delegate: d,
+			result:   result100,
+			addrs:    addrs,
+		})
+
+		if err := jrnl.Complete(step); err != nil {
+			return fmt.Errorf("journal: %s", err)
 		}
 	}
+	return nil
+}
 
-	netOutRules := cfg.RuntimeConfig.NetOutRules
-	if err := netOutProvider.BulkInsertRules(netOutRules); err != nil {
-		return fmt.Errorf("bulk insert: %s", err) // not tested
+// rollbackNetworks calls DelegateDel for every network in networks, most
+// recently added first, logging rather than failing on individual errors.
+// It's shared by every place in cmdAdd that has to undo delegate calls
+// addNetworks already completed: a later network failing, and a later
+// phase (store.Add) failing after every network succeeded.
+func rollbackNetworks(pluginController *lib.PluginController, networks []network) {
+	for i := len(networks) - 1; i >= 0; i-- {
+		if err := pluginController.DelegateDel(networks[i].delegate.Delegate); err != nil {
+			fmt.Fprintf(os.Stderr, "rolling back network %q: delegate delete: %s\n", networks[i].ifName, err)
+		}
 	}
+}
 
-	err = pluginController.AddIPMasq(containerIP.String(), cfg.NoMasqueradeCIDRRange, cfg.VTEPName)
-	if err != nil {
-		return fmt.Errorf("error setting up default ip masq rule: %s", err)
+// rollbackJournal undoes every step in steps, using delegates to recover
+// the delegate config a "delegate:<ifName>" step needs to call DelegateDel.
+// Callers pass the full set of steps a previous ADD for containerID
+// recorded, done or not: Initialize and DelegateAdd aren't safe to call
+// twice for the same (containerHandle, containerIP)/network, so a retried
+// ADD has to undo everything a prior attempt finished, not just what it
+// left half-done, before it can safely start over. It's best-effort: a CNI
+// ADD that finds a stale journal is already in a degraded situation, and
+// logging and moving on beats failing the new ADD over cleanup of the old
+// one.
+func rollbackJournal(pluginController *lib.PluginController, store *datastore.Store, ruleEngineCfg legacynet.RuleEngineConfig, ruleEngineKind, containerID string, delegates []lib.NetworkDelegate, steps []string) {
+	for _, step := range steps {
+		switch {
+		case step == journal.StoreStep:
+			if _, err := store.Delete(containerID); err != nil {
+				fmt.Fprintf(os.Stderr, "journal rollback: store delete: %s\n", err)
+			}
+
+		default:
+			if ifName, ok := journal.ParseDelegateStep(step); ok {
+				for _, d := range delegates {
+					if d.IfName != ifName {
+						continue
+					}
+					if err := pluginController.DelegateDel(d.Delegate); err != nil {
+						fmt.Fprintf(os.Stderr, "journal rollback: delegate delete %q: %s\n", ifName, err)
+					}
+				}
+				continue
+			}
+
+			if ifName, containerIP, ok := journal.ParseRuleStep(step); ok {
+				ipt := pluginController.IPTables
+				if net.ParseIP(containerIP).To4() == nil {
+					ipt = pluginController.IP6Tables
+				}
+				ruleEngine, err := legacynet.NewRuleEngine(ruleEngineKind, ipt, pluginController, ruleEngineCfg)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "journal rollback: selecting rule engine: %s\n", err)
+					continue
+				}
+				if err := ruleEngine.Cleanup(containerID+"/"+ifName, containerIP); err != nil {
+					fmt.Fprintf(os.Stderr, "journal rollback: rule engine cleanup: %s\n", err)
+				}
+			}
+		}
 	}
+}
 
-	result030.DNS.Nameservers = cfg.DNSServers
-	return result030.Print()
+// mergeNetworkResults combines every network's delegate result into a
+// single CNI result, so the runtime sees all attached networks from one
+// ADD response. Every interface each delegate returned is kept, in network
+// order, and each IP's interface index is shifted to its entry in the
+// merged list; a delegate that returned several interfaces contributes
+// several entries, not one.
+func mergeNetworkResults(networks []network) *types100.Result {
+	merged := &types100.Result{CNIVersion: networks[0].result.CNIVersion}
+
+	for _, netw := range networks {
+		ifaceOffset := len(merged.Interfaces)
+		for _, iface := range netw.result.Interfaces {
+			name := iface.Name
+			if name == "" {
+				name = netw.ifName
+			}
+			merged.Interfaces = append(merged.Interfaces, &types100.Interface{
+				Name:    name,
+				Mac:     iface.Mac,
+				Sandbox: iface.Sandbox,
+			})
+		}
+
+		for i := range netw.result.IPs {
+			ipc := *netw.result.IPs[i]
+			if ipc.Interface != nil {
+				offsetIndex := *ipc.Interface + ifaceOffset
+				ipc.Interface = &offsetIndex
+			}
+			merged.IPs = append(merged.IPs, &ipc)
+		}
+
+		merged.Routes = append(merged.Routes, netw.result.Routes...)
+	}
+
+	return merged
 }
 
 func getLocalDNSServers(allDNSServers []string) ([]string, error) {
@@ -189,6 +463,9 @@ func cmdDel(args *skel.CmdArgs) error {
 		return err
 	}
 
+	rec := metrics.NewRecorder("del")
+	defer rec.Done(n.MetricsSocket, n.MetricsTextfileDir)
+
 	store := &datastore.Store{
 		Serializer: &serial.Serial{},
 		Locker: &filelock.Locker{
@@ -205,25 +482,31 @@ func cmdDel(args *skel.CmdArgs) error {
 		fmt.Fprintf(os.Stderr, "store delete: %s", err)
 	}
 
+	// A journal left behind by an ADD that crashed before store.Add ever
+	// ran means container, above, is the zero value and has no networks to
+	// tear down, even though rule engine state for it may still exist on
+	// the host. The journal recorded every rule step that ADD started
+	// regardless of whether the datastore entry ever landed, so fall back
+	// to it for full teardown.
+	jrnl, jrnlErr := journal.Open(n.Datastore, args.ContainerID)
+	if jrnlErr != nil {
+		fmt.Fprintf(os.Stderr, "opening journal: %s", jrnlErr)
+	}
+
 	pluginController, err := newPluginController(n.IPTablesLockFile)
 	if err != nil {
 		return err
 	}
 
-	if err := pluginController.DelegateDel(n.Delegate); err != nil {
-		fmt.Fprintf(os.Stderr, "delegate delete: %s", err)
-	}
-
-	netInProvider := legacynet.NetIn{
-		ChainNamer: &legacynet.ChainNamer{
-			MaxLength: 28,
-		},
-		IPTables:   pluginController.IPTables,
-		IngressTag: n.IngressTag,
+	delegates := n.Delegates
+	if len(delegates) == 0 {
+		delegates = []lib.NetworkDelegate{{IfName: args.IfName, Delegate: n.Delegate}}
 	}
 
-	if err = netInProvider.Cleanup(args.ContainerID); err != nil {
-		fmt.Fprintf(os.Stderr, "net in cleanup: %s", err)
+	for _, d := range delegates {
+		if err := pluginController.DelegateDel(d.Delegate); err != nil {
+			fmt.Fprintf(os.Stderr, "delegate delete for network %q: %s", d.IfName, err)
+		}
 	}
 
 	interfaceNameLookup := interfacelookup.InterfaceNameLookup{
@@ -240,24 +523,59 @@ func cmdDel(args *skel.CmdArgs) error {
 		}
 	}
 
-	netOutProvider := legacynet.NetOut{
-		ChainNamer: &legacynet.ChainNamer{
-			MaxLength: 28,
-		},
-		IPTables:           pluginController.IPTables,
-		Converter:          &legacynet.NetOutRuleConverter{Logger: os.Stderr},
-		ContainerHandle:    args.ContainerID,
-		ContainerIP:        container.IP,
-		HostInterfaceNames: interfaceNames,
+	ruleEngineCfg := legacynet.RuleEngineConfig{
+		IngressTag:            n.IngressTag,
+		VTEPName:              n.VTEPName,
+		NoMasqueradeCIDRRange: n.NoMasqueradeCIDRRange,
+		HostInterfaceNames:    interfaceNames,
 	}
 
-	if err = netOutProvider.Cleanup(); err != nil {
-		fmt.Fprintf(os.Stderr, "net out cleanup: %s", err)
+	// journalIPs mirrors container.Networks but is sourced from the
+	// journal's rule steps, so a crashed ADD's partial state is still
+	// found even when container.Networks came back empty.
+	journalIPs := map[string][]string{}
+	if jrnl != nil {
+		for _, step := range jrnl.Steps() {
+			if ifName, ip, ok := journal.ParseRuleStep(step); ok {
+				journalIPs[ifName] = append(journalIPs[ifName], ip)
+			}
+		}
 	}
 
-	err = pluginController.DelIPMasq(container.IP, n.NoMasqueradeCIDRRange, n.VTEPName)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "removing IP masq: %s", err)
+	// container.Networks maps each attached network's ifname to the IPs
+	// (v4, v6, or both) it was given, mirroring how ADD recorded them.
+	for _, d := range delegates {
+		containerHandle := args.ContainerID + "/" + d.IfName
+
+		ips := map[string]bool{}
+		for _, ip := range container.Networks[d.IfName] {
+			ips[ip] = true
+		}
+		for _, ip := range journalIPs[d.IfName] {
+			ips[ip] = true
+		}
+
+		for containerIP := range ips {
+			ipt := pluginController.IPTables
+			if net.ParseIP(containerIP).To4() == nil {
+				ipt = pluginController.IP6Tables
+			}
+
+			ruleEngine, err := legacynet.NewRuleEngine(n.RuleEngine, ipt, pluginController, ruleEngineCfg)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "selecting rule engine: %s", err)
+				continue
+			}
+			if err := ruleEngine.Cleanup(containerHandle, containerIP); err != nil {
+				fmt.Fprintf(os.Stderr, "rule engine cleanup: %s", err)
+			}
+		}
+	}
+
+	if jrnl != nil {
+		if err := jrnl.Remove(); err != nil {
+			fmt.Fprintf(os.Stderr, "removing journal: %s\n", err)
+		}
 	}
 
 	return nil
@@ -269,26 +587,42 @@ func newPluginController(iptablesLockFile string) (*lib.PluginController, error)
 		return nil, err
 	}
 
+	ip6t, err := iptables.New(iptables.IPFamily(iptables.ProtocolIPv6))
+	if err != nil {
+		return nil, err
+	}
+
 	iptLocker := &filelock.Locker{
 		FileLocker: filelock.NewLocker(iptablesLockFile),
 		Mutex:      &sync.Mutex{},
 	}
 	restorer := &rules.Restorer{}
+	iptablesMetrics := rules.NewMetrics(prometheus.DefaultRegisterer)
 	lockedIPTables := &rules.LockedIPTables{
 		IPTables: ipt,
 		Locker:   iptLocker,
 		Restorer: restorer,
+		Metrics:  iptablesMetrics,
+	}
+	lockedIP6Tables := &rules.LockedIPTables{
+		IPTables: ip6t,
+		Locker:   iptLocker,
+		Restorer: restorer,
+		Metrics:  iptablesMetrics,
 	}
 
 	pluginController := &lib.PluginController{
 		Delegator: lib.NewDelegator(),
 		IPTables:  lockedIPTables,
+		IP6Tables: lockedIP6Tables,
 	}
 	return pluginController, nil
 }
 
 func main() {
-	supportedVersions := []string{"0.3.1"}
+	// 0.4.0 and 1.0.0 add the dual-stack IPs array that ADD now relies on;
+	// 0.3.1 stays supported for delegates that haven't upgraded yet.
+	supportedVersions := []string{"0.3.1", "0.4.0", "1.0.0"}
 
 	skel.PluginMain(cmdAdd, cmdDel, version.PluginSupports(supportedVersions...))
 }
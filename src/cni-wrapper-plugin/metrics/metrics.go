@@ -0,0 +1,103 @@
+// Package metrics times a single cmdAdd/cmdDel invocation of the wrapper
+// plugin. A CNI plugin process exits as soon as it answers the runtime, so
+// it can't serve its own /metrics endpoint; instead it hands its samples to
+// silk-daemon, which does. Recorder.Done tries a Unix-socket write to the daemon
+// first and falls back to writing a Prometheus textfile under textfileDir,
+// which the daemon's textfile collector scrapes. The textfile is named only
+// after the op ("add" or "del") and is replaced atomically on every
+// invocation, so it reflects the most recent ADD/DEL of that kind instead
+// of growing one file per container forever.
+package metrics
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// Recorder times the phases of a single CNI ADD or DEL.
+type Recorder struct {
+	op     string // "add" or "del"
+	start  time.Time
+	phases []phaseSample
+}
+
+type phaseSample struct {
+	name     string
+	duration time.Duration
+}
+
+// NewRecorder starts timing a cmdAdd ("add") or cmdDel ("del") invocation.
+func NewRecorder(op string) *Recorder {
+	return &Recorder{op: op, start: time.Now()}
+}
+
+// Observe records how long a single named phase (delegate, store,
+// netin-init, netout-init, bulk-insert-rules, masquerade, ...) took.
+func (r *Recorder) Observe(name string, duration time.Duration) {
+	r.phases = append(r.phases, phaseSample{name: name, duration: duration})
+}
+
+// Done finalizes the recording and delivers it to the daemon, either over
+// socketPath or, failing that, by replacing a textfile under
+// textfileDir. Delivery errors are swallowed: a metrics push must never
+// fail a CNI ADD/DEL.
+func (r *Recorder) Done(socketPath, textfileDir string) {
+	total := time.Since(r.start)
+
+	lines := []string{
+		fmt.Sprintf("silk_cni_%s_duration_seconds %f", r.op, total.Seconds()),
+	}
+	for _, p := range r.phases {
+		lines = append(lines, fmt.Sprintf("silk_cni_%s_phase_duration_seconds{phase=%q} %f", r.op, p.name, p.duration.Seconds()))
+	}
+
+	if socketPath != "" && pushToSocket(socketPath, lines) == nil {
+		return
+	}
+	if textfileDir != "" {
+		_ = writeTextfile(textfileDir, r.op, lines)
+	}
+}
+
+func pushToSocket(socketPath string, lines []string) error {
+	conn, err := net.DialTimeout("unix", socketPath, time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	for _, line := range lines {
+		if _, err := fmt.Fprintln(conn, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeTextfile replaces dir/cni_<op>.prom with lines. It writes to a
+// temporary file in dir first and renames it into place, so the daemon's
+// textfile collector never sees a partially-written file, and so repeated
+// ADDs/DELs overwrite the same path instead of leaving one file per
+// invocation behind.
+func writeTextfile(dir, op string, lines []string) error {
+	path := fmt.Sprintf("%s/cni_%s.prom", dir, op)
+
+	tmp, err := os.CreateTemp(dir, fmt.Sprintf(".cni_%s_%d_*.prom.tmp", op, os.Getpid()))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	for _, line := range lines {
+		if _, err := fmt.Fprintln(tmp, line); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
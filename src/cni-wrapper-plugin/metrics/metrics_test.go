@@ -0,0 +1,61 @@
+package metrics_test
+
+import (
+	"os"
+	"path/filepath"
+
+	"cni-wrapper-plugin/metrics"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Recorder", func() {
+	var textfileDir string
+
+	BeforeEach(func() {
+		var err error
+		textfileDir, err = os.MkdirTemp("", "cni-metrics")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(textfileDir)
+	})
+
+	It("writes one textfile per op, not one per invocation", func() {
+		rec := metrics.NewRecorder("add")
+		rec.Observe("delegate", 0)
+		rec.Done("", textfileDir)
+
+		rec = metrics.NewRecorder("add")
+		rec.Observe("delegate", 0)
+		rec.Done("", textfileDir)
+
+		entries, err := os.ReadDir(textfileDir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(entries).To(HaveLen(1))
+		Expect(entries[0].Name()).To(Equal("cni_add.prom"))
+	})
+
+	It("leaves no temp files behind", func() {
+		rec := metrics.NewRecorder("del")
+		rec.Done("", textfileDir)
+
+		entries, err := os.ReadDir(textfileDir)
+		Expect(err).NotTo(HaveOccurred())
+		for _, e := range entries {
+			Expect(filepath.Ext(e.Name())).NotTo(Equal(".tmp"))
+		}
+	})
+
+	It("contains the recorded phase samples", func() {
+		rec := metrics.NewRecorder("add")
+		rec.Observe("delegate", 0)
+		rec.Done("", textfileDir)
+
+		contents, err := os.ReadFile(filepath.Join(textfileDir, "cni_add.prom"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(contents)).To(ContainSubstring(`silk_cni_add_phase_duration_seconds{phase="delegate"}`))
+	})
+})
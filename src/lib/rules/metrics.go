@@ -0,0 +1,105 @@
+package rules
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Registerer is the subset of prometheus.Registerer that Metrics needs.
+// Tests can pass a prometheus.NewRegistry() here to avoid colliding with
+// the default global registry.
+type Registerer interface {
+	Register(prometheus.Collector) error
+	MustRegister(...prometheus.Collector)
+}
+
+// Metrics instruments a LockedIPTables: how many iptables invocations it
+// issues (broken down by table/chain/verb), how long callers wait on the
+// underlying filelock, and how large its restore batches are.
+type Metrics struct {
+	invocations      *prometheus.CounterVec
+	lockWaitSeconds  prometheus.Histogram
+	restoreBatchSize prometheus.Histogram
+}
+
+// NewMetrics builds a Metrics and registers its collectors with registerer.
+// Pass prometheus.DefaultRegisterer in production and a private
+// prometheus.NewRegistry() in tests.
+//
+// cmdAdd and cmdDel each build their own PluginController, so a single
+// process (as in a test binary that drives both in sequence) can call
+// NewMetrics against the same registerer more than once. Re-registering the
+// same collector name is expected in that case, not a bug, so NewMetrics
+// reuses whatever was registered first instead of panicking.
+func NewMetrics(registerer Registerer) *Metrics {
+	invocations := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "silk",
+		Subsystem: "iptables",
+		Name:      "invocations_total",
+		Help:      "Total number of iptables/ip6tables invocations, by table, chain and verb.",
+	}, []string{"table", "chain", "verb"})
+	lockWaitSeconds := prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "silk",
+		Subsystem: "iptables",
+		Name:      "lock_wait_seconds",
+		Help:      "Time spent waiting to acquire the iptables file lock.",
+		Buckets:   prometheus.DefBuckets,
+	})
+	restoreBatchSize := prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "silk",
+		Subsystem: "iptables",
+		Name:      "restore_batch_size",
+		Help:      "Number of rules included in a single iptables-restore batch.",
+		Buckets:   []float64{1, 2, 4, 8, 16, 32, 64, 128, 256},
+	})
+
+	return &Metrics{
+		invocations:      registerOrReuse(registerer, invocations).(*prometheus.CounterVec),
+		lockWaitSeconds:  registerOrReuse(registerer, lockWaitSeconds).(prometheus.Histogram),
+		restoreBatchSize: registerOrReuse(registerer, restoreBatchSize).(prometheus.Histogram),
+	}
+}
+
+// registerOrReuse registers c with registerer, returning c itself on
+// success. If registerer already has a collector under the same name
+// (from an earlier NewMetrics call against it), that existing collector is
+// returned instead so every caller accumulates into the same series. Any
+// other registration failure is still fatal, via the same MustRegister
+// panic NewMetrics used before.
+func registerOrReuse(registerer Registerer, c prometheus.Collector) prometheus.Collector {
+	if err := registerer.Register(c); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			return are.ExistingCollector
+		}
+		registerer.MustRegister(c)
+	}
+	return c
+}
+
+// RecordInvocation counts a single iptables/ip6tables invocation. LockedIPTables
+// calls this around each Append/Insert/Delete/etc. call it issues.
+func (m *Metrics) RecordInvocation(table, chain, verb string) {
+	if m == nil {
+		return
+	}
+	m.invocations.WithLabelValues(table, chain, verb).Inc()
+}
+
+// ObserveLockWait records how long a caller waited on the iptables filelock
+// before LockedIPTables could proceed.
+func (m *Metrics) ObserveLockWait(waited time.Duration) {
+	if m == nil {
+		return
+	}
+	m.lockWaitSeconds.Observe(waited.Seconds())
+}
+
+// ObserveRestoreBatch records the number of rules passed to a single
+// iptables-restore call, e.g. from BulkInsertRules.
+func (m *Metrics) ObserveRestoreBatch(numRules int) {
+	if m == nil {
+		return
+	}
+	m.restoreBatchSize.Observe(float64(numRules))
+}
@@ -0,0 +1,73 @@
+package rules_test
+
+import (
+	"lib/rules"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var _ = Describe("Metrics", func() {
+	var registry *prometheus.Registry
+
+	BeforeEach(func() {
+		registry = prometheus.NewRegistry()
+	})
+
+	It("registers its collectors with the given registerer", func() {
+		m := rules.NewMetrics(registry)
+		// A CounterVec is only gathered once it has a labelled series.
+		m.RecordInvocation("filter", "netout-1", "insert")
+
+		families, err := registry.Gather()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(families).To(HaveLen(3))
+	})
+
+	It("does not panic when called again against the same registerer", func() {
+		var m *rules.Metrics
+		Expect(func() {
+			rules.NewMetrics(registry)
+			m = rules.NewMetrics(registry)
+		}).NotTo(Panic())
+		m.RecordInvocation("filter", "netout-1", "insert")
+
+		families, err := registry.Gather()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(families).To(HaveLen(3))
+	})
+
+	It("accumulates into the same series across repeated calls", func() {
+		m1 := rules.NewMetrics(registry)
+		m1.RecordInvocation("filter", "netout-1", "insert")
+
+		m2 := rules.NewMetrics(registry)
+		m2.RecordInvocation("filter", "netout-1", "insert")
+
+		families, err := registry.Gather()
+		Expect(err).NotTo(HaveOccurred())
+
+		var total float64
+		for _, f := range families {
+			if f.GetName() != "silk_iptables_invocations_total" {
+				continue
+			}
+			for _, metric := range f.GetMetric() {
+				total += metric.GetCounter().GetValue()
+			}
+		}
+		Expect(total).To(Equal(2.0))
+	})
+})
+
+var _ = Describe("nil Metrics", func() {
+	It("tolerates Record/Observe calls on a nil receiver", func() {
+		var m *rules.Metrics
+		Expect(func() {
+			m.RecordInvocation("filter", "netout-1", "insert")
+			m.ObserveLockWait(0)
+			m.ObserveRestoreBatch(0)
+		}).NotTo(Panic())
+	})
+})